@@ -1,141 +1,362 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
-	"io"
+	"flag"
+	"fmt"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/kardianos/service"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/Tendwa-T/InternetMonitor/metrics"
+	"github.com/Tendwa-T/InternetMonitor/paths"
+	"github.com/Tendwa-T/InternetMonitor/probe"
+	"github.com/Tendwa-T/InternetMonitor/retention"
+	"github.com/Tendwa-T/InternetMonitor/scheduler"
+	"github.com/Tendwa-T/InternetMonitor/speedtest"
 )
 
 const Version = "1.1.0"
 
+// jitterProbeCount is the number of TCP dials used to estimate RTT jitter
+// and packet loss on each scheduled connectivity check.
+const jitterProbeCount = 20
+
+// quorumFraction is the share of weighted probe targets that must succeed
+// for a cycle to be considered online.
+const quorumFraction = 0.5
+
+// measurementInterval is how often the scheduler runs a speed measurement
+// on its own, independent of /status traffic.
+const measurementInterval = time.Minute
+
+// connectivityInterval is how often the scheduler runs a connectivity
+// check (probe fan-out plus the jitter/packet-loss burst) independent of
+// /status traffic.
+const connectivityInterval = 15 * time.Second
+
 type Status struct {
 	Online            bool      `json:"online"`
 	LatencyMs         float64   `json:"latency_ms"`
 	Timestamp         time.Time `json:"timestamp"`
 	DownloadSpeedMbps float64   `json:"download_speed_mbps"`
+	UploadSpeedMbps   float64   `json:"upload_speed_mbps"`
+	JitterMs          float64   `json:"jitter_ms"`
+	PacketLossPct     float64   `json:"packet_loss_pct"`
 	Version           string    `json:"version"`
 }
 
 type Config struct {
-	LatencyThresholdMs float64 `json:"latencyThresholdMs"`
-	DegradedSpeedMbps  float64 `json:"degradedSpeedMbps"`
+	LatencyThresholdMs float64        `json:"latencyThresholdMs"`
+	DegradedSpeedMbps  float64        `json:"degradedSpeedMbps"`
+	Probes             []probe.Target `json:"probes"`
+	SpeedTestEndpoints []string       `json:"speedTestEndpoints"`
+	RawRetentionDays   int            `json:"rawRetentionDays"`
 }
 
-// Shared variables for download speed tracking and concurrency control
+// Shared variables holding the latest known connection-quality snapshot.
+// Concurrency-safety for the measurements that populate them is handled by
+// the scheduler package, not by guarding them here.
 var (
-	speedMutex          sync.RWMutex
-	lastSpeed           float64
-	lastRecordedSpeed   float64 // Track last recorded speed to avoid consecutive zeros
-	guardMutex          sync.Mutex
-	measuring           bool      // Flag to prevent concurrent measurements
-	lastMeasurementTime time.Time // Track last measurement time for cooldown
-	measurementCooldown = 30 * time.Second
-	httpClient          = &http.Client{
-		Timeout: 30 * time.Second,
-		Transport: &http.Transport{
-			MaxIdleConns:        2,
-			MaxIdleConnsPerHost: 1,
-		},
-	}
+	speedMutex        sync.RWMutex
+	lastSpeed         float64
+	lastRecordedSpeed float64 // Track last recorded speed to avoid consecutive zeros
+	lastUploadSpeed   float64
+	lastJitterMs      float64
+	lastPacketLossPct float64
+	lastOnline        bool
+	lastLatencyMs     float64
 )
 
-func loadConfig() Config {
-	path := os.ExpandEnv("$HOME/Library/Application Support/InternetMonitor/config.json")
+func loadConfig(path string) Config {
+	defaults := Config{
+		LatencyThresholdMs: 150,
+		DegradedSpeedMbps:  10,
+		Probes:             probe.DefaultTargets(),
+		RawRetentionDays:   retention.DefaultConfig().RawRetentionDays,
+	}
+
 	data, err := os.ReadFile(path)
 	if err != nil {
-		return Config{LatencyThresholdMs: 150, DegradedSpeedMbps: 10}
+		return defaults
 	}
-	var cfg Config
+
+	cfg := defaults
 	if err := json.Unmarshal(data, &cfg); err != nil {
 		log.Printf("Failed to parse config.json, using defaults: %v", err)
-		return Config{LatencyThresholdMs: 150, DegradedSpeedMbps: 10}
+		return defaults
+	}
+	if len(cfg.Probes) == 0 {
+		cfg.Probes = probe.DefaultTargets()
 	}
 	return cfg
 }
 
-func checkConnectivity() Status {
-	start := time.Now()
-	conn, err := net.DialTimeout("tcp", "1.1.1.1:53", 2*time.Second)
-	if err != nil {
+// checkConnectivity runs every configured probe target in parallel and
+// returns both the aggregated Status and the per-target report so the
+// caller can persist it to probe_history.
+func checkConnectivity(cfg Config) (Status, probe.Report) {
+	metrics.MeasurementsTotal.Inc()
+
+	report := probe.Run(context.Background(), cfg.Probes, quorumFraction)
+	if !report.Online {
+		metrics.MeasurementsFailedTotal.Inc()
 		return Status{
 			Online:    false,
 			Timestamp: time.Now(),
 			Version:   Version,
-		}
+		}, report
 	}
-	defer conn.Close()
-	latency := time.Since(start).Seconds() * 1000
+
+	latency := averageLatency(report.Results)
+	metrics.LatencyHistogram.Observe(latency / 1000)
+
+	jitter, lossPct := measureJitterAndLoss(primaryProbeAddress(report), jitterProbeCount)
+
 	return Status{
-		Online:    true,
-		LatencyMs: latency,
-		Timestamp: time.Now(),
-		Version:   Version,
+		Online:        true,
+		LatencyMs:     latency,
+		JitterMs:      jitter,
+		PacketLossPct: lossPct,
+		Timestamp:     time.Now(),
+		Version:       Version,
+	}, report
+}
+
+// averageLatency returns the mean latency across the targets that
+// succeeded this cycle, or 0 if none did.
+func averageLatency(results []probe.Result) float64 {
+	var sum float64
+	var n int
+	for _, r := range results {
+		if r.Online {
+			sum += r.LatencyMs
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
 	}
+	return sum / float64(n)
 }
 
-// Asynchronous download speed measurement
-func measureDownloadSpeedAsync(db *sql.DB) {
-	// Check if measurement already in progress or cooldown not elapsed
-	guardMutex.Lock()
-	if measuring || time.Since(lastMeasurementTime) < measurementCooldown {
-		guardMutex.Unlock()
-		return
+// primaryProbeAddress picks a TCP-dialable target that actually succeeded
+// this cycle to reuse for the jitter/packet-loss burst, so a dead target
+// that quorum is already discounting can't stall the burst for up to
+// jitterProbeCount dial timeouts. Falls back to the Cloudflare DNS
+// resolver if nothing suitable succeeded.
+func primaryProbeAddress(report probe.Report) string {
+	for _, r := range report.Results {
+		if !r.Online {
+			continue
+		}
+		if r.Target.Protocol == "" || r.Target.Protocol == "tcp" || r.Target.Protocol == "icmp" {
+			return r.Target.Address
+		}
 	}
-	measuring = true
-	guardMutex.Unlock()
+	return "1.1.1.1:53"
+}
 
-	go func() {
-		defer func() {
-			guardMutex.Lock()
-			measuring = false
-			lastMeasurementTime = time.Now()
-			guardMutex.Unlock()
-		}()
+// measureJitterAndLoss dials target `count` times and returns the stddev of
+// the round-trip latencies (jitter) along with the percentage (0-100) of
+// dials that failed (packet loss). Used in place of ICMP pings since raw sockets
+// usually require elevated privileges.
+func measureJitterAndLoss(target string, count int) (jitterMs, lossPct float64) {
+	latencies := make([]float64, 0, count)
+	failures := 0
 
-		log.Println("Starting download speed measurement")
+	for i := 0; i < count; i++ {
 		start := time.Now()
-		url := "https://speed.cloudflare.com/__down?bytes=5000000" // 5 MB test file
-		resp, err := httpClient.Get(url)
+		conn, err := net.DialTimeout("tcp", target, 2*time.Second)
 		if err != nil {
-			log.Printf("Download failed: %v", err)
-			updateLastSpeed(0, db)
-			return
+			failures++
+			continue
 		}
-		defer resp.Body.Close()
-		n, err := io.Copy(io.Discard, resp.Body)
+		latencies = append(latencies, time.Since(start).Seconds()*1000)
+		conn.Close()
+	}
+
+	lossPct = float64(failures) / float64(count) * 100
+	if len(latencies) < 2 {
+		return 0, lossPct
+	}
+
+	mean := 0.0
+	for _, l := range latencies {
+		mean += l
+	}
+	mean /= float64(len(latencies))
+
+	variance := 0.0
+	for _, l := range latencies {
+		variance += (l - mean) * (l - mean)
+	}
+	variance /= float64(len(latencies))
+
+	return math.Sqrt(variance), lossPct
+}
+
+// newSpeedMeasurement returns the function the scheduler runs: it ramps
+// download concurrency via the speedtest package rather than doing a
+// single fixed-size fetch, persists one row per concurrency level so the
+// UI can plot how the link scales with parallelism, then measures upload
+// throughput and records both alongside the latest jitter/packet-loss
+// reading in a single history row. The scheduler guarantees this never
+// runs concurrently with itself, so it needs no locking of its own.
+func newSpeedMeasurement(db *sql.DB, cfg Config) func() {
+	return func() {
+		log.Println("Starting autotuning speed test")
+		downloadMbps := 0.0
+		samples, err := runDownloadSpeedtest(context.Background(), cfg)
 		if err != nil {
-			log.Printf("Failed to read response: %v", err)
-			updateLastSpeed(0, db)
-			return
+			log.Printf("Download speed test failed: %v", err)
+		} else {
+			for _, s := range samples {
+				log.Printf("Speed test: concurrency=%d %.2f Mbps (%d bytes in %s)",
+					s.Concurrency, s.ThroughputMbps, s.BytesTransferred, s.Duration)
+				recordSpeedtestRun(db, s)
+				if s.ThroughputMbps > downloadMbps {
+					downloadMbps = s.ThroughputMbps
+				}
+			}
 		}
-		duration := time.Since(start).Seconds()
-		if duration == 0 {
-			updateLastSpeed(0, db)
-			return
+
+		uploadMbps := 0.0
+		uploadSample, err := speedtest.RunUpload(context.Background(), speedtest.DefaultUploadConfig())
+		if err != nil {
+			log.Printf("Upload speed test failed: %v", err)
+		} else {
+			uploadMbps = uploadSample.ThroughputMbps
+			log.Printf("Upload speed: %.2f Mbps (%d bytes in %s)",
+				uploadMbps, uploadSample.BytesTransferred, uploadSample.Duration)
+		}
+
+		recordMeasurement(db, downloadMbps, uploadMbps)
+	}
+}
+
+// newConnectivityCheck returns the function the scheduler runs: fanning out
+// to every configured probe target, measuring jitter/packet-loss against
+// whichever target actually succeeded this cycle, persisting one
+// probe_history row per target, and updating the shared snapshot that
+// /status reads. The scheduler guarantees this never runs concurrently
+// with itself, so a burst of /status traffic can no longer pile up
+// concurrent dial bursts against the same external target.
+func newConnectivityCheck(db *sql.DB, cfg Config) func() {
+	return func() {
+		status, report := checkConnectivity(cfg)
+		recordProbeHistory(db, report)
+
+		speedMutex.Lock()
+		lastOnline = status.Online
+		lastLatencyMs = status.LatencyMs
+		if status.Online {
+			lastJitterMs = status.JitterMs
+			lastPacketLossPct = status.PacketLossPct
+		}
+		speedMutex.Unlock()
+	}
+}
+
+// speedtestEndpoints returns the configured download endpoints to try, in
+// order, falling back to the Cloudflare default when the operator hasn't
+// supplied any of their own.
+func speedtestEndpoints(cfg Config) []string {
+	if len(cfg.SpeedTestEndpoints) > 0 {
+		return cfg.SpeedTestEndpoints
+	}
+	return []string{speedtest.DefaultConfig().Endpoint}
+}
+
+// runDownloadSpeedtest tries each configured endpoint in turn and returns
+// the ramp from the first one that completes, so a single endpoint having
+// a bad day doesn't fail the whole measurement cycle.
+func runDownloadSpeedtest(ctx context.Context, cfg Config) ([]speedtest.Sample, error) {
+	var lastErr error
+	for _, endpoint := range speedtestEndpoints(cfg) {
+		sc := speedtest.DefaultConfig()
+		sc.Endpoint = endpoint
+		samples, err := speedtest.Run(ctx, sc)
+		if err == nil {
+			return samples, nil
+		}
+		log.Printf("Speed test endpoint %s failed: %v", endpoint, err)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// recordProbeHistory persists one row per probe target for this cycle.
+func recordProbeHistory(db *sql.DB, report probe.Report) {
+	stmt, err := db.Prepare(`INSERT INTO probe_history(
+		ts, name, address, protocol, online, latency_ms
+	) VALUES(?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		log.Printf("Failed to prepare probe_history statement: %v", err)
+		return
+	}
+	defer stmt.Close()
+
+	for _, r := range report.Results {
+		if _, err := stmt.Exec(r.Timestamp, r.Target.Name, r.Target.Address, r.Target.Protocol, r.Online, r.LatencyMs); err != nil {
+			log.Printf("Failed to insert probe history for %s: %v", r.Target.Name, err)
 		}
-		mbps := float64(n*8) / duration / 1_000_000
-		log.Printf("Download speed: %.2f Mbps (%d bytes in %.2f sec)", mbps, n, duration)
-		updateLastSpeed(mbps, db)
-	}()
+	}
+}
+
+// recordSpeedtestRun persists one concurrency level's results.
+func recordSpeedtestRun(db *sql.DB, s speedtest.Sample) {
+	perConn, err := json.Marshal(s.PerConnMbps)
+	if err != nil {
+		log.Printf("Failed to marshal per-connection throughput: %v", err)
+		perConn = []byte("[]")
+	}
+
+	stmt, err := db.Prepare(`INSERT INTO speedtest_runs(
+		ts, concurrency, bytes, duration_ms, throughput_mbps, per_conn_mbps
+	) VALUES(?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		log.Printf("Failed to prepare speedtest_runs statement: %v", err)
+		return
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(s.Timestamp, s.Concurrency, s.BytesTransferred,
+		s.Duration.Milliseconds(), s.ThroughputMbps, string(perConn))
+	if err != nil {
+		log.Printf("Failed to insert speedtest run: %v", err)
+	}
 }
 
-// Update lastSpeed and insert history
-func updateLastSpeed(speed float64, db *sql.DB) {
+// recordMeasurement updates the shared download/upload speed state and
+// inserts a history row carrying the latest connectivity, latency and
+// jitter/packet-loss reading alongside it.
+func recordMeasurement(db *sql.DB, downloadMbps, uploadMbps float64) {
 	speedMutex.Lock()
-	lastSpeed = speed
-	// Skip DB write if speed is 0 and last recorded speed was also 0 (avoid consecutive zeros)
-	shouldWrite := speed != 0 || lastRecordedSpeed != 0
+	lastSpeed = downloadMbps
+	lastUploadSpeed = uploadMbps
+	// Skip DB write if download speed is 0 and last recorded speed was also 0 (avoid consecutive zeros)
+	shouldWrite := downloadMbps != 0 || lastRecordedSpeed != 0
 	if shouldWrite {
-		lastRecordedSpeed = speed
+		lastRecordedSpeed = downloadMbps
 	}
+	online := lastOnline
+	latency := lastLatencyMs
+	jitter := lastJitterMs
+	lossPct := lastPacketLossPct
 	speedMutex.Unlock()
 
 	if !shouldWrite {
@@ -143,23 +364,114 @@ func updateLastSpeed(speed float64, db *sql.DB) {
 		return
 	}
 
-	stmt, err := db.Prepare("INSERT INTO history(ts, online, latency, speed, version) VALUES(?, ?, ?, ?, ?)")
+	stmt, err := db.Prepare(`INSERT INTO history(
+		ts, online, latency, speed, upload_speed, jitter_ms, packet_loss_pct, version
+	) VALUES(?, ?, ?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		log.Printf("Failed to prepare DB statement: %v", err)
 		return
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(time.Now(), true, 0, speed, Version)
+	_, err = stmt.Exec(time.Now(), online, latency, downloadMbps, uploadMbps, jitter, lossPct, Version)
 	if err != nil {
 		log.Printf("Failed to insert history: %v", err)
 	}
 }
 
+// addColumn adds column to table if it isn't already present, so existing
+// databases pick up new fields without losing their history.
+func addColumn(db *sql.DB, table, column, sqlType string) {
+	_, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + sqlType)
+	if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+		log.Printf("Failed to add column %s.%s: %v", table, column, err)
+	}
+}
+
+// parseHistoryQuery extracts resolution/from/to from a /history request,
+// defaulting to the raw table and the last 24 hours.
+func parseHistoryQuery(q url.Values) (retention.QueryParams, error) {
+	params := retention.QueryParams{
+		Resolution: retention.Raw,
+		From:       time.Now().Add(-24 * time.Hour),
+		To:         time.Now(),
+	}
+
+	if res := q.Get("resolution"); res != "" {
+		params.Resolution = retention.Resolution(res)
+	}
+	if from := q.Get("from"); from != "" {
+		t, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			return params, fmt.Errorf("invalid from: %w", err)
+		}
+		params.From = t
+	}
+	if to := q.Get("to"); to != "" {
+		t, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			return params, fmt.Errorf("invalid to: %w", err)
+		}
+		params.To = t
+	}
+
+	return params, nil
+}
+
+// program adapts runAgent to github.com/kardianos/service's Interface so
+// the agent can run under launchd/systemd/the Windows service manager as
+// well as interactively.
+type program struct {
+	dirs paths.Dirs
+}
+
+func (p *program) Start(s service.Service) error {
+	go runAgent(p.dirs)
+	return nil
+}
+
+func (p *program) Stop(s service.Service) error {
+	return nil
+}
+
 func main() {
+	svcFlag := flag.String("service", "", "control the background service: install, uninstall, start, stop")
+	workDir := flag.String("work-dir", "", "override the base directory for config.json and history.db")
+	flag.Parse()
+
+	dirs, err := paths.Resolve(*workDir)
+	if err != nil {
+		log.Fatal("Failed to resolve config/data directories:", err)
+	}
+
+	svc, err := service.New(&program{dirs: dirs}, &service.Config{
+		Name:        "InternetMonitor",
+		DisplayName: "Internet Monitor Agent",
+		Description: "Monitors internet connectivity and link quality.",
+	})
+	if err != nil {
+		log.Fatal("Failed to create service:", err)
+	}
+
+	if *svcFlag != "" {
+		if err := service.Control(svc, *svcFlag); err != nil {
+			log.Fatalf("Failed to %s service: %v", *svcFlag, err)
+		}
+		return
+	}
+
+	if err := svc.Run(); err != nil {
+		log.Fatal("Service run failed:", err)
+	}
+}
 
-	dbPath := os.ExpandEnv("$HOME/Library/Application Support/InternetMonitor/history.db")
-	db, err := sql.Open("sqlite3", dbPath)
+func runAgent(dirs paths.Dirs) {
+	if err := dirs.Ensure(); err != nil {
+		log.Fatal("Failed to create config/data directories:", err)
+	}
+	cfg := loadConfig(dirs.ConfigPath())
+
+	db, err := sql.Open("sqlite3", dirs.DBPath())
 	if err != nil {
 		log.Fatal("Failed to open database:", err)
 	}
@@ -170,31 +482,105 @@ func main() {
 		online BOOLEAN,
 		latency REAL,
 		speed REAL,
+		upload_speed REAL,
+		jitter_ms REAL,
+		packet_loss_pct REAL,
 		version TEXT
 	)`)
 	if err != nil {
 		log.Fatal("Failed to create table:", err)
 	}
 
-	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
-		status := checkConnectivity()
+	// Migration path for pre-existing databases created before upload/jitter/
+	// packet-loss tracking was added.
+	for _, col := range []string{"upload_speed", "jitter_ms", "packet_loss_pct"} {
+		addColumn(db, "history", col, "REAL")
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS speedtest_runs(
+		ts DATETIME,
+		concurrency INTEGER,
+		bytes INTEGER,
+		duration_ms INTEGER,
+		throughput_mbps REAL,
+		per_conn_mbps TEXT
+	)`)
+	if err != nil {
+		log.Fatal("Failed to create speedtest_runs table:", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS probe_history(
+		ts DATETIME,
+		name TEXT,
+		address TEXT,
+		protocol TEXT,
+		online BOOLEAN,
+		latency_ms REAL
+	)`)
+	if err != nil {
+		log.Fatal("Failed to create probe_history table:", err)
+	}
+
+	if err := retention.Migrate(db); err != nil {
+		log.Fatal("Failed to migrate retention schema:", err)
+	}
+	go retention.Run(context.Background(), db, retention.Config{
+		RawRetentionDays: cfg.RawRetentionDays,
+		Interval:         retention.DefaultConfig().Interval,
+	})
+
+	scheduler.New(measurementInterval, newSpeedMeasurement(db, cfg))
+	scheduler.New(connectivityInterval, newConnectivityCheck(db, cfg))
 
-		// Always return the latest known speed without waiting
+	prometheus.MustRegister(metrics.NewCollector(func() metrics.Snapshot {
 		speedMutex.RLock()
-		status.DownloadSpeedMbps = lastSpeed
+		defer speedMutex.RUnlock()
+		return metrics.Snapshot{
+			Online:       lastOnline,
+			LatencyMs:    lastLatencyMs,
+			DownloadMbps: lastSpeed,
+		}
+	}))
+	http.Handle("/metrics", promhttp.Handler())
+
+	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		// Purely a read of the latest snapshot: the probe fan-out and
+		// jitter/packet-loss burst run on their own schedule via
+		// newConnectivityCheck, not on the request path.
+		speedMutex.RLock()
+		status := Status{
+			Online:            lastOnline,
+			LatencyMs:         lastLatencyMs,
+			DownloadSpeedMbps: lastSpeed,
+			UploadSpeedMbps:   lastUploadSpeed,
+			JitterMs:          lastJitterMs,
+			PacketLossPct:     lastPacketLossPct,
+		}
 		speedMutex.RUnlock()
 
 		status.Timestamp = time.Now()
 		status.Version = Version
 
-		// Immediately return status
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(status)
+	})
 
-		// Trigger new speed measurement if online
-		if status.Online {
-			measureDownloadSpeedAsync(db)
+	http.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) {
+		params, err := parseHistoryQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
+
+		rows, err := retention.Query(db, params)
+		if err != nil {
+			log.Printf("Failed to query history: %v", err)
+			http.Error(w, "failed to query history", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rows)
 	})
 
 	log.Println("Agent Running on http://127.0.0.1:8787")
@@ -0,0 +1,96 @@
+// Package metrics exposes the agent's connectivity state as Prometheus
+// metrics so it can be scraped straight into a Prometheus/Grafana stack
+// instead of polling the ad-hoc /status JSON endpoint.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// MeasurementsTotal counts every connectivity check attempted.
+	MeasurementsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "internetmonitor_measurements_total",
+		Help: "Total number of connectivity measurements attempted.",
+	})
+
+	// MeasurementsFailedTotal counts connectivity checks that came back
+	// offline.
+	MeasurementsFailedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "internetmonitor_measurements_failed_total",
+		Help: "Total number of connectivity measurements that failed.",
+	})
+
+	// LatencyHistogram tracks the distribution of connectivity check
+	// latency, in seconds, per Prometheus's base-unit convention.
+	LatencyHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "internetmonitor_latency_seconds",
+		Help:    "Distribution of connectivity check latency in seconds.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+// Snapshot is the subset of agent state exposed as gauges. It is read from
+// the agent's in-memory state on every scrape rather than triggering a new
+// probe, so scrapes stay cheap.
+type Snapshot struct {
+	Online       bool
+	LatencyMs    float64
+	DownloadMbps float64
+}
+
+// SnapshotFunc returns the agent's most recently known state.
+type SnapshotFunc func() Snapshot
+
+// Collector adapts a SnapshotFunc to prometheus.Collector, exposing
+// internetmonitor_online, internetmonitor_latency_ms and
+// internetmonitor_download_mbps gauges.
+type Collector struct {
+	snapshot SnapshotFunc
+
+	online       *prometheus.Desc
+	latencyMs    *prometheus.Desc
+	downloadMbps *prometheus.Desc
+}
+
+// NewCollector builds a Collector that reads state via snapshot on every
+// Collect call.
+func NewCollector(snapshot SnapshotFunc) *Collector {
+	return &Collector{
+		snapshot: snapshot,
+		online: prometheus.NewDesc(
+			"internetmonitor_online",
+			"1 if the last connectivity check succeeded, 0 otherwise.",
+			nil, nil,
+		),
+		latencyMs: prometheus.NewDesc(
+			"internetmonitor_latency_ms",
+			"Latency of the last connectivity check, in milliseconds.",
+			nil, nil,
+		),
+		downloadMbps: prometheus.NewDesc(
+			"internetmonitor_download_mbps",
+			"Most recently measured download throughput, in Mbps.",
+			nil, nil,
+		),
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.online
+	ch <- c.latencyMs
+	ch <- c.downloadMbps
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	s := c.snapshot()
+
+	onlineVal := 0.0
+	if s.Online {
+		onlineVal = 1.0
+	}
+	ch <- prometheus.MustNewConstMetric(c.online, prometheus.GaugeValue, onlineVal)
+	ch <- prometheus.MustNewConstMetric(c.latencyMs, prometheus.GaugeValue, s.LatencyMs)
+	ch <- prometheus.MustNewConstMetric(c.downloadMbps, prometheus.GaugeValue, s.DownloadMbps)
+}
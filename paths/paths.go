@@ -0,0 +1,67 @@
+// Package paths resolves where the agent's config and data files live.
+//
+// The agent used to hardcode "$HOME/Library/Application Support/...", which
+// only works on macOS. Resolve uses os.UserConfigDir()/os.UserCacheDir()
+// instead, so the agent picks up the right convention on Linux
+// (~/.config/InternetMonitor) and Windows (%AppData%) too.
+package paths
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const appName = "InternetMonitor"
+
+// Dirs holds the resolved config and data directories for one run of the
+// agent.
+type Dirs struct {
+	ConfigDir string
+	DataDir   string
+}
+
+// Resolve returns the directories to use. If workDir is non-empty (set via
+// the --work-dir flag), config and data both live under it; otherwise they
+// follow the OS convention, with config.json under the user config dir and
+// history.db under the user cache dir.
+func Resolve(workDir string) (Dirs, error) {
+	if workDir != "" {
+		return Dirs{ConfigDir: workDir, DataDir: workDir}, nil
+	}
+
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return Dirs{}, fmt.Errorf("paths: resolving config dir: %w", err)
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return Dirs{}, fmt.Errorf("paths: resolving cache dir: %w", err)
+	}
+
+	return Dirs{
+		ConfigDir: filepath.Join(configDir, appName),
+		DataDir:   filepath.Join(cacheDir, appName),
+	}, nil
+}
+
+// ConfigPath returns the path to config.json under d.
+func (d Dirs) ConfigPath() string {
+	return filepath.Join(d.ConfigDir, "config.json")
+}
+
+// DBPath returns the path to history.db under d.
+func (d Dirs) DBPath() string {
+	return filepath.Join(d.DataDir, "history.db")
+}
+
+// Ensure creates d's directories if they don't already exist.
+func (d Dirs) Ensure() error {
+	if err := os.MkdirAll(d.ConfigDir, 0o755); err != nil {
+		return fmt.Errorf("paths: creating config dir: %w", err)
+	}
+	if err := os.MkdirAll(d.DataDir, 0o755); err != nil {
+		return fmt.Errorf("paths: creating data dir: %w", err)
+	}
+	return nil
+}
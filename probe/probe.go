@@ -0,0 +1,126 @@
+// Package probe runs connectivity checks against a configurable set of
+// targets and aggregates them into an overall online/offline verdict.
+//
+// A single hardcoded target (e.g. one anycast POP) can have a bad day
+// without the rest of the internet being down, so Run fans out to every
+// configured target in parallel each cycle and only calls the link
+// offline once a quorum of targets agree.
+package probe
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Target describes one connectivity check to run each cycle.
+type Target struct {
+	Name     string  `json:"name"`
+	Address  string  `json:"address"`  // host:port for tcp/icmp, URL for http
+	Protocol string  `json:"protocol"` // "tcp", "http", or "icmp"
+	Weight   float64 `json:"weight"`
+}
+
+// Result is one target's outcome for a single cycle.
+type Result struct {
+	Target    Target
+	Online    bool
+	LatencyMs float64
+	Err       error
+	Timestamp time.Time
+}
+
+// Report aggregates the results of one probing cycle.
+type Report struct {
+	Results []Result
+	Online  bool
+}
+
+// DefaultTargets is used when the config doesn't specify any probes.
+func DefaultTargets() []Target {
+	return []Target{
+		{Name: "cloudflare-dns", Address: "1.1.1.1:53", Protocol: "tcp", Weight: 1},
+	}
+}
+
+// Run executes every target concurrently and aggregates the results.
+// Online is true once the combined weight of successful targets reaches
+// quorum (a fraction between 0 and 1) of the total weight.
+func Run(ctx context.Context, targets []Target, quorum float64) Report {
+	results := make([]Result, len(targets))
+
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t Target) {
+			defer wg.Done()
+			results[i] = runTarget(ctx, t)
+		}(i, t)
+	}
+	wg.Wait()
+
+	var totalWeight, okWeight float64
+	for _, r := range results {
+		w := r.Target.Weight
+		if w <= 0 {
+			w = 1
+		}
+		totalWeight += w
+		if r.Online {
+			okWeight += w
+		}
+	}
+
+	return Report{
+		Results: results,
+		Online:  totalWeight > 0 && okWeight/totalWeight >= quorum,
+	}
+}
+
+func runTarget(ctx context.Context, t Target) Result {
+	start := time.Now()
+
+	var err error
+	switch t.Protocol {
+	case "http", "https":
+		err = probeHTTP(ctx, t.Address)
+	default:
+		// No raw-socket ICMP without elevated privileges, so "icmp" and
+		// the "tcp" default both resolve to a TCP dial.
+		err = probeTCP(ctx, t.Address)
+	}
+
+	return Result{
+		Target:    t,
+		Online:    err == nil,
+		LatencyMs: time.Since(start).Seconds() * 1000,
+		Err:       err,
+		Timestamp: time.Now(),
+	}
+}
+
+func probeTCP(ctx context.Context, address string) error {
+	d := net.Dialer{Timeout: 2 * time.Second}
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+func probeHTTP(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,337 @@
+// Package retention prunes raw history rows and rolls them up into
+// coarser-grained tables so a long-running agent doesn't grow an unbounded
+// SQLite file, and so range queries over months of data stay fast.
+package retention
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// SchemaVersion is bumped whenever the rollup schema changes; Migrate
+// records it so future migrations can tell what's already been applied.
+const SchemaVersion = 1
+
+// Resolution identifies a rollup granularity.
+type Resolution string
+
+const (
+	Raw   Resolution = "raw"
+	Res5m Resolution = "5m"
+	Res1h Resolution = "1h"
+	Res1d Resolution = "1d"
+)
+
+var (
+	tableNames = map[Resolution]string{
+		Res5m: "history_5m",
+		Res1h: "history_1h",
+		Res1d: "history_1d",
+	}
+	bucketSizes = map[Resolution]time.Duration{
+		Res5m: 5 * time.Minute,
+		Res1h: time.Hour,
+		Res1d: 24 * time.Hour,
+	}
+)
+
+// TableFor returns the table backing a rollup resolution, or an error if
+// res isn't one of Res5m, Res1h or Res1d.
+func TableFor(res Resolution) (string, error) {
+	t, ok := tableNames[res]
+	if !ok {
+		return "", fmt.Errorf("retention: unknown resolution %q", res)
+	}
+	return t, nil
+}
+
+// Config controls how long raw rows are kept and how often the
+// prune+rollup loop runs.
+type Config struct {
+	RawRetentionDays int
+	Interval         time.Duration
+}
+
+// DefaultConfig is used when the agent config doesn't override retention
+// settings.
+func DefaultConfig() Config {
+	return Config{RawRetentionDays: 7, Interval: time.Hour}
+}
+
+// Migrate creates the rollup and schema-version tables if they don't
+// already exist, and records the current SchemaVersion. It is safe to call
+// on every startup.
+func Migrate(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations(version INTEGER NOT NULL)`); err != nil {
+		return fmt.Errorf("retention: creating schema_migrations: %w", err)
+	}
+
+	const rollupColumns = `(
+		ts DATETIME,
+		min_latency REAL, avg_latency REAL, max_latency REAL, p95_latency REAL,
+		min_speed REAL, avg_speed REAL, max_speed REAL, p95_speed REAL,
+		samples INTEGER
+	)`
+	for _, table := range tableNames {
+		if _, err := db.Exec("CREATE TABLE IF NOT EXISTS " + table + rollupColumns); err != nil {
+			return fmt.Errorf("retention: creating %s: %w", table, err)
+		}
+	}
+
+	var current int
+	err := db.QueryRow(`SELECT version FROM schema_migrations LIMIT 1`).Scan(&current)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = db.Exec(`INSERT INTO schema_migrations(version) VALUES(?)`, SchemaVersion)
+	case err != nil:
+		return fmt.Errorf("retention: reading schema version: %w", err)
+	case current < SchemaVersion:
+		_, err = db.Exec(`UPDATE schema_migrations SET version = ?`, SchemaVersion)
+	}
+	if err != nil {
+		return fmt.Errorf("retention: recording schema version: %w", err)
+	}
+	return nil
+}
+
+// Run prunes and rolls up history on cfg.Interval until ctx is cancelled.
+// It runs one pass immediately so a freshly started agent doesn't wait a
+// full interval before its first rollup.
+func Run(ctx context.Context, db *sql.DB, cfg Config) {
+	runOnce(db, cfg)
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			runOnce(db, cfg)
+		}
+	}
+}
+
+func runOnce(db *sql.DB, cfg Config) {
+	for res := range tableNames {
+		if err := RollUp(db, res); err != nil {
+			log.Printf("retention: rollup %s: %v", res, err)
+		}
+	}
+	if err := Prune(db, cfg.RawRetentionDays); err != nil {
+		log.Printf("retention: prune: %v", err)
+	}
+}
+
+// Prune deletes raw history and probe_history rows older than
+// rawRetentionDays. probe_history grows fastest of the raw tables since
+// it's written once per probe target per cycle, so it needs the same
+// bound as history.
+func Prune(db *sql.DB, rawRetentionDays int) error {
+	cutoff := time.Now().AddDate(0, 0, -rawRetentionDays)
+	if _, err := db.Exec(`DELETE FROM history WHERE ts < ?`, cutoff); err != nil {
+		return fmt.Errorf("retention: pruning history: %w", err)
+	}
+	if _, err := db.Exec(`DELETE FROM probe_history WHERE ts < ?`, cutoff); err != nil {
+		return fmt.Errorf("retention: pruning probe_history: %w", err)
+	}
+	return nil
+}
+
+type bucketAggregate struct {
+	bucket    time.Time
+	latencies []float64
+	speeds    []float64
+}
+
+// RollUp summarizes raw history rows into res's table, picking up where
+// the last rollup for that resolution left off. The most recent bucket is
+// skipped while less than one bucket size has passed since its start, since
+// it may still be accumulating rows.
+func RollUp(db *sql.DB, res Resolution) error {
+	table, err := TableFor(res)
+	if err != nil {
+		return err
+	}
+	bucketSize := bucketSizes[res]
+
+	// Select the column directly rather than via MAX(ts): the sqlite
+	// driver only converts a result to time.Time when it can see the
+	// column's declared type, which an aggregate expression loses.
+	var since sql.NullTime
+	err = db.QueryRow("SELECT ts FROM " + table + " ORDER BY ts DESC LIMIT 1").Scan(&since)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("retention: reading last rollup ts for %s: %w", table, err)
+	}
+
+	// since.Time is the start of the last bucket already rolled up, whose
+	// raw rows span [since.Time, since.Time+bucketSize); resume strictly
+	// after that range so the bucket isn't re-aggregated into a duplicate
+	// row.
+	cutoff := since.Time.Add(bucketSize)
+
+	rows, err := db.Query(`SELECT ts, latency, speed FROM history WHERE ts >= ? ORDER BY ts`, cutoff)
+	if err != nil {
+		return fmt.Errorf("retention: reading raw history: %w", err)
+	}
+	defer rows.Close()
+
+	buckets := map[time.Time]*bucketAggregate{}
+	var order []time.Time
+	for rows.Next() {
+		var ts time.Time
+		var latency, speed float64
+		if err := rows.Scan(&ts, &latency, &speed); err != nil {
+			return fmt.Errorf("retention: scanning raw history: %w", err)
+		}
+		start := ts.Truncate(bucketSize)
+		a, ok := buckets[start]
+		if !ok {
+			a = &bucketAggregate{bucket: start}
+			buckets[start] = a
+			order = append(order, start)
+		}
+		a.latencies = append(a.latencies, latency)
+		a.speeds = append(a.speeds, speed)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("retention: iterating raw history: %w", err)
+	}
+
+	sort.Slice(order, func(i, j int) bool { return order[i].Before(order[j]) })
+	if len(order) > 0 && time.Since(order[len(order)-1]) < bucketSize {
+		order = order[:len(order)-1]
+	}
+	if len(order) == 0 {
+		return nil
+	}
+
+	stmt, err := db.Prepare(`INSERT INTO ` + table + `(
+		ts, min_latency, avg_latency, max_latency, p95_latency,
+		min_speed, avg_speed, max_speed, p95_speed, samples
+	) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("retention: preparing rollup insert for %s: %w", table, err)
+	}
+	defer stmt.Close()
+
+	for _, bucket := range order {
+		a := buckets[bucket]
+		latMin, latAvg, latMax, latP95 := summarize(a.latencies)
+		spdMin, spdAvg, spdMax, spdP95 := summarize(a.speeds)
+		if _, err := stmt.Exec(a.bucket, latMin, latAvg, latMax, latP95,
+			spdMin, spdAvg, spdMax, spdP95, len(a.latencies)); err != nil {
+			return fmt.Errorf("retention: inserting rollup row into %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+func summarize(values []float64) (min, avg, max, p95 float64) {
+	if len(values) == 0 {
+		return 0, 0, 0, 0
+	}
+
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	min = sorted[0]
+	max = sorted[len(sorted)-1]
+
+	sum := 0.0
+	for _, v := range sorted {
+		sum += v
+	}
+	avg = sum / float64(len(sorted))
+
+	idx := int(math.Ceil(0.95*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	p95 = sorted[idx]
+	return min, avg, max, p95
+}
+
+// Row is one summarized (or, for Raw, pass-through) history sample,
+// shaped for the /history JSON API.
+type Row struct {
+	Timestamp  time.Time `json:"timestamp"`
+	MinLatency float64   `json:"min_latency_ms"`
+	AvgLatency float64   `json:"avg_latency_ms"`
+	MaxLatency float64   `json:"max_latency_ms"`
+	P95Latency float64   `json:"p95_latency_ms"`
+	MinSpeed   float64   `json:"min_speed_mbps"`
+	AvgSpeed   float64   `json:"avg_speed_mbps"`
+	MaxSpeed   float64   `json:"max_speed_mbps"`
+	P95Speed   float64   `json:"p95_speed_mbps"`
+	Samples    int       `json:"samples"`
+}
+
+// QueryParams describes a /history request.
+type QueryParams struct {
+	Resolution Resolution
+	From, To   time.Time
+}
+
+// Query returns the rows for params.Resolution within [From, To], picking
+// the raw table or the appropriate rollup table.
+func Query(db *sql.DB, params QueryParams) ([]Row, error) {
+	if params.Resolution == Raw || params.Resolution == "" {
+		return queryRaw(db, params)
+	}
+
+	table, err := TableFor(params.Resolution)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT
+		ts, min_latency, avg_latency, max_latency, p95_latency,
+		min_speed, avg_speed, max_speed, p95_speed, samples
+		FROM `+table+` WHERE ts >= ? AND ts <= ? ORDER BY ts`, params.From, params.To)
+	if err != nil {
+		return nil, fmt.Errorf("retention: querying %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	var out []Row
+	for rows.Next() {
+		var r Row
+		if err := rows.Scan(&r.Timestamp, &r.MinLatency, &r.AvgLatency, &r.MaxLatency, &r.P95Latency,
+			&r.MinSpeed, &r.AvgSpeed, &r.MaxSpeed, &r.P95Speed, &r.Samples); err != nil {
+			return nil, fmt.Errorf("retention: scanning %s row: %w", table, err)
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+func queryRaw(db *sql.DB, params QueryParams) ([]Row, error) {
+	rows, err := db.Query(`SELECT ts, latency, speed FROM history WHERE ts >= ? AND ts <= ? ORDER BY ts`,
+		params.From, params.To)
+	if err != nil {
+		return nil, fmt.Errorf("retention: querying raw history: %w", err)
+	}
+	defer rows.Close()
+
+	var out []Row
+	for rows.Next() {
+		var ts time.Time
+		var latency, speed float64
+		if err := rows.Scan(&ts, &latency, &speed); err != nil {
+			return nil, fmt.Errorf("retention: scanning raw history row: %w", err)
+		}
+		out = append(out, Row{
+			Timestamp:  ts,
+			MinLatency: latency, AvgLatency: latency, MaxLatency: latency, P95Latency: latency,
+			MinSpeed: speed, AvgSpeed: speed, MaxSpeed: speed, P95Speed: speed,
+			Samples: 1,
+		})
+	}
+	return out, rows.Err()
+}
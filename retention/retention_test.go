@@ -0,0 +1,132 @@
+package retention
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("opening in-memory db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec(`CREATE TABLE history(ts DATETIME, latency REAL, speed REAL)`); err != nil {
+		t.Fatalf("creating history table: %v", err)
+	}
+	if err := Migrate(db); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	return db
+}
+
+func insertHistory(t *testing.T, db *sql.DB, ts time.Time, latency, speed float64) {
+	t.Helper()
+	if _, err := db.Exec(`INSERT INTO history(ts, latency, speed) VALUES(?, ?, ?)`, ts, latency, speed); err != nil {
+		t.Fatalf("inserting history row: %v", err)
+	}
+}
+
+func rollupRowCount(t *testing.T, db *sql.DB) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM history_5m`).Scan(&n); err != nil {
+		t.Fatalf("counting history_5m rows: %v", err)
+	}
+	return n
+}
+
+// TestRollUpResumesFromLastBucket checks that RollUp only rolls up buckets
+// it hasn't already written, that it skips the most recent bucket while
+// it's still forming, and that calling it repeatedly doesn't duplicate or
+// lose rows for buckets already rolled up.
+func TestRollUpResumesFromLastBucket(t *testing.T) {
+	db := openTestDB(t)
+
+	now := time.Now()
+	bucketA := now.Add(-2 * time.Hour).Truncate(bucketSizes[Res5m])
+	insertHistory(t, db, bucketA.Add(10*time.Second), 10, 100)
+	insertHistory(t, db, bucketA.Add(20*time.Second), 20, 200)
+
+	if err := RollUp(db, Res5m); err != nil {
+		t.Fatalf("RollUp: %v", err)
+	}
+	if got := rollupRowCount(t, db); got != 1 {
+		t.Fatalf("after rolling up bucket A: got %d history_5m rows, want 1", got)
+	}
+
+	var samples int
+	var avgLatency, avgSpeed float64
+	if err := db.QueryRow(`SELECT samples, avg_latency, avg_speed FROM history_5m WHERE ts = ?`, bucketA).
+		Scan(&samples, &avgLatency, &avgSpeed); err != nil {
+		t.Fatalf("reading bucket A rollup row: %v", err)
+	}
+	if samples != 2 || avgLatency != 15 || avgSpeed != 150 {
+		t.Fatalf("bucket A rollup = {samples:%d avgLatency:%v avgSpeed:%v}, want {2 15 150}", samples, avgLatency, avgSpeed)
+	}
+
+	// A second, now-elapsed bucket arrives. RollUp should only pick up the
+	// new bucket, leaving bucket A's row untouched.
+	bucketB := now.Add(-1 * time.Hour).Truncate(bucketSizes[Res5m])
+	insertHistory(t, db, bucketB.Add(5*time.Second), 30, 300)
+
+	if err := RollUp(db, Res5m); err != nil {
+		t.Fatalf("second RollUp: %v", err)
+	}
+	if got := rollupRowCount(t, db); got != 2 {
+		t.Fatalf("after rolling up bucket B: got %d history_5m rows, want 2", got)
+	}
+	if err := db.QueryRow(`SELECT samples, avg_latency, avg_speed FROM history_5m WHERE ts = ?`, bucketA).
+		Scan(&samples, &avgLatency, &avgSpeed); err != nil {
+		t.Fatalf("reading bucket A rollup row after second RollUp: %v", err)
+	}
+	if samples != 2 || avgLatency != 15 || avgSpeed != 150 {
+		t.Fatalf("bucket A rollup changed after second RollUp: {samples:%d avgLatency:%v avgSpeed:%v}", samples, avgLatency, avgSpeed)
+	}
+
+	// A row lands in the bucket that's still forming (close to now). It
+	// must not be rolled up until it's no longer the most recent bucket.
+	insertHistory(t, db, now, 999, 999)
+	if err := RollUp(db, Res5m); err != nil {
+		t.Fatalf("third RollUp: %v", err)
+	}
+	if got := rollupRowCount(t, db); got != 2 {
+		t.Fatalf("after inserting into the still-forming bucket: got %d history_5m rows, want 2 (in-progress bucket should be skipped)", got)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	tests := []struct {
+		name               string
+		values             []float64
+		min, avg, max, p95 float64
+	}{
+		{name: "empty", values: nil, min: 0, avg: 0, max: 0, p95: 0},
+		{name: "single value", values: []float64{42}, min: 42, avg: 42, max: 42, p95: 42},
+		{
+			name:   "twenty ascending values",
+			values: []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+			min:    1, avg: 10.5, max: 20, p95: 19,
+		},
+		{
+			name:   "unsorted input",
+			values: []float64{20, 1, 11, 2, 19},
+			min:    1, avg: 10.6, max: 20, p95: 20,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			min, avg, max, p95 := summarize(tt.values)
+			if min != tt.min || avg != tt.avg || max != tt.max || p95 != tt.p95 {
+				t.Errorf("summarize(%v) = (%v, %v, %v, %v), want (%v, %v, %v, %v)",
+					tt.values, min, avg, max, p95, tt.min, tt.avg, tt.max, tt.p95)
+			}
+		})
+	}
+}
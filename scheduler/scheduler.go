@@ -0,0 +1,68 @@
+// Package scheduler decouples expensive measurements from the request that
+// happens to trigger them. A Scheduler runs its own goroutine and fires a
+// measurement function either on a fixed interval or when something calls
+// Trigger, and guarantees only one run is ever in flight — so a burst of
+// HTTP clients can't race each other into running the same measurement
+// twice, and measurements keep happening even if nobody calls Trigger.
+package scheduler
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Scheduler runs fn on its own goroutine.
+type Scheduler struct {
+	trigger  chan struct{}
+	inFlight atomic.Bool
+	fn       func()
+}
+
+// New starts a Scheduler that calls fn every interval, and also whenever
+// Trigger is called.
+func New(interval time.Duration, fn func()) *Scheduler {
+	s := &Scheduler{
+		trigger: make(chan struct{}, 1),
+		fn:      fn,
+	}
+	go s.run(interval)
+	return s
+}
+
+// Trigger requests an out-of-band run. It never blocks: if a trigger is
+// already queued, this one is dropped, since it would only ask for the
+// same outcome.
+func (s *Scheduler) Trigger() {
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// run fires an initial pass immediately, so a freshly started agent isn't
+// left serving a zeroed snapshot until the first tick, then enters the
+// ticker/trigger loop.
+func (s *Scheduler) run(interval time.Duration) {
+	s.runOnce()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.runOnce()
+		case <-s.trigger:
+			s.runOnce()
+		}
+	}
+}
+
+// runOnce calls fn unless a previous run is still in flight.
+func (s *Scheduler) runOnce() {
+	if !s.inFlight.CompareAndSwap(false, true) {
+		return
+	}
+	defer s.inFlight.Store(false)
+	s.fn()
+}
@@ -0,0 +1,217 @@
+// Package speedtest measures sustained download throughput by ramping
+// concurrency, rather than relying on a single fixed-size fetch.
+//
+// A lone HTTP GET is dominated by TCP slow-start and gives a pessimistic
+// picture of a link's real capacity, especially on multi-gig connections.
+// Run instead starts at one download (a plain GET of the endpoint; no
+// Range header is sent) and doubles the
+// concurrency level (1, 2, 4, 8...) for a fixed step duration each time,
+// stopping once aggregate throughput stops improving meaningfully or a
+// level starts erroring out. This mirrors the autotune mode used by
+// MinIO's warp benchmark.
+package speedtest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Sample is the result of one concurrency level in the ramp. It carries
+// enough detail (per-connection throughput included) for the caller to
+// persist a row per level and let the UI plot how the link scales.
+type Sample struct {
+	Concurrency      int
+	BytesTransferred int64
+	Duration         time.Duration
+	ThroughputMbps   float64
+	PerConnMbps      []float64
+	Timestamp        time.Time
+}
+
+// Config controls the autotune ramp.
+type Config struct {
+	Endpoint       string // URL serving a large/arbitrary-length body, e.g. Cloudflare's __down
+	StepDuration   time.Duration
+	MaxConcurrency int
+	// PlateauDelta is the minimum fractional improvement in aggregate
+	// throughput required to keep ramping up; e.g. 0.1 means the next
+	// level must beat the best seen so far by more than 10%.
+	PlateauDelta float64
+	Client       *http.Client
+}
+
+// DefaultConfig returns the ramp settings used by the agent in production.
+func DefaultConfig() Config {
+	return Config{
+		Endpoint:       "https://speed.cloudflare.com/__down?bytes=104857600",
+		StepDuration:   10 * time.Second,
+		MaxConcurrency: 32,
+		PlateauDelta:   0.1,
+		Client: &http.Client{
+			Timeout: 20 * time.Second,
+		},
+	}
+}
+
+// Run ramps concurrency 1, 2, 4, 8... doubling as long as aggregate
+// throughput keeps improving by more than cfg.PlateauDelta, and returns one
+// Sample per concurrency level that completed; a level that fails is not
+// included. It stops at the first level that
+// plateaus or fails outright, and returns an error only if the very first
+// level (N=1) can't complete at all.
+func Run(ctx context.Context, cfg Config) ([]Sample, error) {
+	var samples []Sample
+	best := 0.0
+	for n := 1; n <= cfg.MaxConcurrency; n *= 2 {
+		sample, err := runLevel(ctx, cfg, n)
+		if err != nil {
+			if len(samples) == 0 {
+				return nil, fmt.Errorf("speedtest: concurrency %d: %w", n, err)
+			}
+			break
+		}
+		samples = append(samples, sample)
+
+		if sample.ThroughputMbps <= best*(1+cfg.PlateauDelta) {
+			break
+		}
+		best = sample.ThroughputMbps
+	}
+	return samples, nil
+}
+
+// runLevel sustains n concurrent downloads against cfg.Endpoint for
+// cfg.StepDuration and reports the aggregate and per-connection throughput.
+func runLevel(ctx context.Context, cfg Config, n int) (Sample, error) {
+	levelCtx, cancel := context.WithTimeout(ctx, cfg.StepDuration)
+	defer cancel()
+
+	var (
+		wg         sync.WaitGroup
+		mu         sync.Mutex
+		perConn    = make([]float64, 0, n)
+		totalBytes int64
+		firstErr   error
+	)
+
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			nb, err := download(levelCtx, cfg.Client, cfg.Endpoint)
+			mu.Lock()
+			defer mu.Unlock()
+			totalBytes += nb
+			if nb > 0 {
+				elapsed := time.Since(start).Seconds()
+				if elapsed > 0 {
+					perConn = append(perConn, float64(nb*8)/elapsed/1_000_000)
+				}
+			}
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}()
+	}
+	wg.Wait()
+	duration := time.Since(start)
+
+	if totalBytes == 0 {
+		if firstErr != nil {
+			return Sample{}, firstErr
+		}
+		return Sample{}, fmt.Errorf("speedtest: no bytes transferred at concurrency %d", n)
+	}
+
+	return Sample{
+		Concurrency:      n,
+		BytesTransferred: totalBytes,
+		Duration:         duration,
+		ThroughputMbps:   float64(totalBytes*8) / duration.Seconds() / 1_000_000,
+		PerConnMbps:      perConn,
+		Timestamp:        time.Now(),
+	}, nil
+}
+
+// UploadConfig controls the single-stream upload probe.
+type UploadConfig struct {
+	Endpoint  string
+	PayloadMB int
+	Client    *http.Client
+}
+
+// DefaultUploadConfig returns the upload settings used by the agent in
+// production.
+func DefaultUploadConfig() UploadConfig {
+	return UploadConfig{
+		Endpoint:  "https://speed.cloudflare.com/__up",
+		PayloadMB: 10,
+		Client: &http.Client{
+			Timeout: 20 * time.Second,
+		},
+	}
+}
+
+// RunUpload POSTs a payload of random bytes to cfg.Endpoint and reports the
+// achieved throughput. Unlike Run, it does not ramp concurrency; a single
+// upload stream is enough to characterize most residential/office uplinks.
+func RunUpload(ctx context.Context, cfg UploadConfig) (Sample, error) {
+	payload := make([]byte, cfg.PayloadMB*1_000_000)
+	if _, err := rand.Read(payload); err != nil {
+		return Sample{}, fmt.Errorf("speedtest: generating upload payload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.Endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return Sample{}, err
+	}
+	req.ContentLength = int64(len(payload))
+
+	start := time.Now()
+	resp, err := cfg.Client.Do(req)
+	if err != nil {
+		return Sample{}, fmt.Errorf("speedtest: upload: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	duration := time.Since(start)
+
+	return Sample{
+		Concurrency:      1,
+		BytesTransferred: int64(len(payload)),
+		Duration:         duration,
+		ThroughputMbps:   float64(len(payload)*8) / duration.Seconds() / 1_000_000,
+		Timestamp:        time.Now(),
+	}, nil
+}
+
+// download streams from url until ctx expires or the body is exhausted,
+// returning the number of bytes read. A context deadline is the expected
+// way a step ends, so it is not treated as an error.
+func download(ctx context.Context, client *http.Client, url string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil && ctx.Err() != nil {
+		err = nil
+	}
+	return n, err
+}